@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/hillu/go-yara/v4"
+)
+
+// ScanBatch handles POST /yara/batch: a single multipart request
+// carrying multiple "sample" parts, scanned independently and
+// returned keyed by filename. Like ScanFile, the request is streamed
+// rather than buffered whole, spilling each sample to a temp file once
+// it exceeds maxMemoryBytes; maxUploadBytes is enforced as a hard cap
+// via http.MaxBytesReader, answered with a 413.
+//
+// curl http://localhost:8080/yara/batch -F "sample=@a.txt" -F "sample=@b.txt" -vvv
+func ScanBatch(pool *WorkerPool, enqueueTimeout time.Duration, metrics *Metrics, maxUploadBytes, maxMemoryBytes int64, tmpDir string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+
+		samples, form, err := collectMultipart(r, maxMemoryBytes, tmpDir)
+		if err == ErrPayloadTooLarge {
+			log.Warnf("Got an upload exceeding the %d byte limit", maxUploadBytes)
+			metrics.ScansTotal.WithLabelValues(outcomeBadRequest).Inc()
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
+			return
+		}
+		if err != nil {
+			log.Errorf("Got an error while parsing multipart form, err = %v", err)
+			metrics.ScansTotal.WithLabelValues(outcomeBadRequest).Inc()
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
+			return
+		}
+		defer closeSamples(samples)
+
+		if len(samples) == 0 {
+			log.Errorf("Got a batch scan request with no sample parts")
+			metrics.ScansTotal.WithLabelValues(outcomeBadRequest).Inc()
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
+			return
+		}
+
+		filteredNamespaces, hasNamespace := form["namespace"]
+		verbose := r.URL.Query().Get("verbose") == "1"
+		path := form.Get("path")
+
+		files := make(map[string]interface{}, len(samples))
+		for _, sample := range samples {
+			sc := scanContextFromUpload(sample, path)
+
+			var matches yara.MatchRules
+			var err error
+			if sample.FilePath != "" {
+				matches, err = pool.ScanPath(sample.FilePath, sample.Size, sc, enqueueTimeout)
+			} else {
+				matches, err = pool.Scan(sample.Data, sc, enqueueTimeout)
+			}
+			if err == ErrQueueFull {
+				log.Warnf("Got an error while enqueuing scan for %s, err = %v", sample.Filename, err)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
+				return
+			}
+			if err != nil {
+				log.Errorf("Got an error scanning %s, err = %v", sample.Filename, err)
+				files[sample.Filename] = map[string]string{"error": err.Error()}
+				continue
+			}
+
+			files[sample.Filename] = formatMatches(matches, verbose, filteredNamespaces, hasNamespace)
+		}
+
+		jsonFiles, _ := json.Marshal(files)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("{\"files\": %s}", jsonFiles)))
+	}
+}
+
+// urlScanRequest is the JSON body expected by ScanURL.
+type urlScanRequest struct {
+	URL string `json:"url"`
+}
+
+// urlFetchClient fetches caller-supplied URLs for ScanURL. It refuses
+// loopback/link-local/private addresses, including ones only reached
+// via a redirect, since req.URL below is fully attacker-controlled.
+var urlFetchClient = newSSRFSafeClient()
+
+// ScanURL handles POST /yara/url: it downloads the given URL, up to
+// maxBytes within fetchTimeout, and scans the result.
+//
+// curl http://localhost:8080/yara/url -d '{"url":"https://example.com/sample.bin"}' -vvv
+func ScanURL(pool *WorkerPool, enqueueTimeout, fetchTimeout time.Duration, maxBytes int64, metrics *Metrics) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req urlScanRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
+			log.Errorf("Got an error decoding url scan request, err = %v", err)
+			metrics.ScansTotal.WithLabelValues(outcomeBadRequest).Inc()
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), fetchTimeout)
+		defer cancel()
+
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, req.URL, nil)
+		if err != nil {
+			log.Errorf("Got an error building request for %s, err = %v", req.URL, err)
+			metrics.ScansTotal.WithLabelValues(outcomeBadRequest).Inc()
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
+			return
+		}
+
+		resp, err := urlFetchClient.Do(httpReq)
+		if err != nil {
+			log.Errorf("Got an error fetching %s, err = %v", req.URL, err)
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
+			return
+		}
+		defer resp.Body.Close()
+
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, io.LimitReader(resp.Body, maxBytes))
+		if err != nil {
+			log.Errorf("Got an error downloading %s, err = %v", req.URL, err)
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
+			return
+		}
+
+		matches, err := pool.Scan(buf.Bytes(), scanContextFromRequest(r, path.Base(req.URL), buf.Bytes()), enqueueTimeout)
+		if err == ErrQueueFull {
+			log.Warnf("Got an error while enqueuing scan for %s, err = %v", req.URL, err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
+			return
+		}
+		if err != nil {
+			log.Errorf("Got an error scanning %s, err = %v", req.URL, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
+			return
+		}
+
+		filteredNamespaces, hasNamespace := r.URL.Query()["namespace"]
+		verbose := r.URL.Query().Get("verbose") == "1"
+
+		jsonMatches, _ := json.Marshal(formatMatches(matches, verbose, filteredNamespaces, hasNamespace))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("{\"matchingRules\": %s}", jsonMatches)))
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
@@ -9,19 +8,22 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/hillu/go-yara/v4"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	"github.com/sirupsen/logrus"
 	"github.com/sqooba/go-common/healthchecks"
 	"github.com/sqooba/go-common/logging"
 	"github.com/sqooba/go-common/version"
-	"io"
 	"io/fs"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var (
@@ -31,12 +33,28 @@ var (
 )
 
 type envConfig struct {
-	YaraRulesDir string `envconfig:"YARA_RULES_DIR"`
-	Port         string `envconfig:"PORT" default:"8080"`
+	YaraRulesDir     string `envconfig:"YARA_RULES_DIR"`
+	Port             string `envconfig:"PORT" default:"8080"`
 	LogLevel         string `envconfig:"LOG_LEVEL_TEST" default:"info"`
 	MetricsNamespace string `envconfig:"METRICS_NAMESPACE" default:"metis"`
 	MetricsSubsystem string `envconfig:"METRICS_SUBSYSTEM" default:"yararestapi"`
 	MetricsPath      string `envconfig:"METRICS_PATH" default:"/metrics"`
+
+	YaraWorkers        int           `envconfig:"YARA_WORKERS"`
+	YaraQueueSize      int           `envconfig:"YARA_QUEUE_SIZE" default:"128"`
+	YaraEnqueueTimeout time.Duration `envconfig:"YARA_ENQUEUE_TIMEOUT" default:"5s"`
+
+	YaraRulesSources         []string      `envconfig:"YARA_RULES_SOURCES"`
+	YaraRulesCacheDir        string        `envconfig:"YARA_RULES_CACHE_DIR" default:"/tmp/yara-rules-cache"`
+	YaraRulesRefreshInterval time.Duration `envconfig:"YARA_RULES_REFRESH_INTERVAL"`
+	YaraRulesReloadTimeout   time.Duration `envconfig:"YARA_RULES_RELOAD_TIMEOUT" default:"60s"`
+
+	YaraURLFetchTimeout time.Duration `envconfig:"YARA_URL_FETCH_TIMEOUT" default:"10s"`
+	YaraURLMaxBytes     int64         `envconfig:"YARA_URL_MAX_BYTES" default:"104857600"`
+
+	MaxUploadBytes int64  `envconfig:"MAX_UPLOAD_BYTES" default:"536870912"`
+	MaxMemoryBytes int64  `envconfig:"MAX_MEMORY_BYTES" default:"33554432"`
+	ScanTmpDir     string `envconfig:"SCAN_TMP_DIR"`
 }
 
 func main() {
@@ -73,25 +91,71 @@ func main() {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
-	rules, err := loadRulesFromDir(env.YaraRulesDir)
-	if err != nil {
-		log.Errorf("Got an error while loading yara rules from dir %s, err = %v", env.YaraRulesDir, err)
+	var sources []RuleSource
+	if env.YaraRulesDir != "" {
+		sources = append(sources, &dirRuleSource{dir: env.YaraRulesDir})
+	}
+	for _, raw := range env.YaraRulesSources {
+		source, err := ParseRuleSource(raw)
+		if err != nil {
+			log.Errorf("Got an error parsing rule source %q, err = %v", raw, err)
+			return
+		}
+		sources = append(sources, source)
+	}
+	if len(sources) == 0 {
+		log.Errorf("No yara rule source configured: set YARA_RULES_DIR and/or YARA_RULES_SOURCES")
 		return
 	}
 
-	log.Infof("Successfully loaded %d rules from dir %s, err = %v", len(rules.GetRules()), env.YaraRulesDir, err)
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry, env.MetricsNamespace, env.MetricsSubsystem)
 
-	scanner, err := yara.NewScanner(rules)
+	rulesManager := NewRulesManager(sources, env.YaraRulesCacheDir)
+	reloadCtx, cancelReload := context.WithTimeout(context.Background(), env.YaraRulesReloadTimeout)
+	rulesCount, err := rulesManager.Reload(reloadCtx)
+	cancelReload()
+	metrics.ObserveReload(rulesCount, err)
 	if err != nil {
-		log.Errorf("Got an error while loading yara scanner from rules, err = %v", err)
+		log.Errorf("Got an error while loading yara rules from %d source(s), err = %v", len(sources), err)
 		return
 	}
+	rules := rulesManager.Current()
+
+	log.Infof("Successfully loaded %d rules from %d source(s)", len(rules.GetRules()), len(sources))
+
+	if env.YaraWorkers <= 0 {
+		env.YaraWorkers = runtime.NumCPU()
+	}
+
+	pool := NewWorkerPool(rules, env.YaraWorkers, env.YaraQueueSize, metrics)
+	pool.Start()
+	log.Infof("Started %d scan workers with a queue size of %d", env.YaraWorkers, env.YaraQueueSize)
+
+	if env.YaraRulesRefreshInterval > 0 {
+		go refreshRulesPeriodically(rulesManager, pool, metrics, env.YaraRulesRefreshInterval, env.YaraRulesReloadTimeout)
+	}
 
 	// curl http://localhost:8080/yara -F "sample=@test.txt" -vvv
-	router.HandleFunc("/yara", ScanFile(scanner)).Methods("POST")
+	router.HandleFunc("/yara", ScanFile(pool, env.YaraEnqueueTimeout, metrics, env.MaxUploadBytes, env.MaxMemoryBytes, env.ScanTmpDir)).Methods("POST")
+
+	// curl http://localhost:8080/yara/batch -F "sample=@a.txt" -F "sample=@b.txt" -vvv
+	router.HandleFunc("/yara/batch", ScanBatch(pool, env.YaraEnqueueTimeout, metrics, env.MaxUploadBytes, env.MaxMemoryBytes, env.ScanTmpDir)).Methods("POST")
+
+	// curl http://localhost:8080/yara/url -d '{"url":"https://example.com/sample.bin"}' -vvv
+	router.HandleFunc("/yara/url", ScanURL(pool, env.YaraEnqueueTimeout, env.YaraURLFetchTimeout, env.YaraURLMaxBytes, metrics)).Methods("POST")
 
 	// curl http://localhost:8080/debug/rules -vvv
-	router.HandleFunc("/debug/rules", ListRules(rules)).Methods("GET")
+	router.HandleFunc("/debug/rules", ListRules(rulesManager)).Methods("GET")
+
+	// curl http://localhost:8080/stats -vvv
+	router.HandleFunc("/stats", Stats(pool)).Methods("GET")
+
+	// curl -X POST http://localhost:8080/admin/reload -vvv
+	router.HandleFunc("/admin/reload", AdminReload(rulesManager, pool, metrics)).Methods("POST")
+
+	// curl http://localhost:8080/metrics -vvv
+	router.Handle(env.MetricsPath, promhttp.HandlerFor(registry, promhttp.HandlerOpts{})).Methods("GET")
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
@@ -114,62 +178,130 @@ func logWhenError(f func() error, label string, log *logrus.Logger) func() error
 	}
 }
 
-func ScanFile(scanner *yara.Scanner) func(w http.ResponseWriter, r *http.Request) {
+// ScanFile handles POST /yara: a single multipart request carrying one
+// "sample" part. The request body is streamed via MultipartReader
+// rather than buffered whole, spilling the sample to a temp file once
+// it exceeds maxMemoryBytes; maxUploadBytes is enforced as a hard cap
+// via http.MaxBytesReader, answered with a 413.
+func ScanFile(pool *WorkerPool, enqueueTimeout time.Duration, metrics *Metrics, maxUploadBytes, maxMemoryBytes int64, tmpDir string) func(w http.ResponseWriter, r *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := r.ParseMultipartForm(32 << 24) // 512 MB
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+
+		samples, form, err := collectMultipart(r, maxMemoryBytes, tmpDir)
+		if err == ErrPayloadTooLarge {
+			log.Warnf("Got an upload exceeding the %d byte limit", maxUploadBytes)
+			metrics.ScansTotal.WithLabelValues(outcomeBadRequest).Inc()
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
+			return
+		}
 		if err != nil {
 			log.Errorf("Got an error while parsing multipart form, err = %v", err)
+			metrics.ScansTotal.WithLabelValues(outcomeBadRequest).Inc()
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
 			return
 		}
+		defer closeSamples(samples)
 
-		file, header, err := r.FormFile("sample")
-		if err != nil {
-			log.Errorf("Got an error while getting file %s from form, err = %v", header.Filename, err)
+		if len(samples) == 0 {
+			log.Errorf("Got a scan request with no sample part")
+			metrics.ScansTotal.WithLabelValues(outcomeBadRequest).Inc()
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
 			return
 		}
-		defer file.Close()
-
-		var buf bytes.Buffer
-		_, err = io.Copy(&buf, file)
-		if err != nil {
-			log.Errorf("Got an error copying file to buf, err = %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+		sample := samples[0]
+		sc := scanContextFromUpload(sample, form.Get("path"))
+
+		var matches yara.MatchRules
+		if sample.FilePath != "" {
+			matches, err = pool.ScanPath(sample.FilePath, sample.Size, sc, enqueueTimeout)
+		} else {
+			matches, err = pool.Scan(sample.Data, sc, enqueueTimeout)
+		}
+		if err == ErrQueueFull {
+			log.Warnf("Got an error while enqueuing scan for %s, err = %v", sample.Filename, err)
+			w.WriteHeader(http.StatusServiceUnavailable)
 			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
 			return
 		}
-
-		var m yara.MatchRules
-		err = scanner.SetCallback(&m).ScanMem(buf.Bytes())
 		if err != nil {
-			log.Errorf("Got an error scanning mem %d, err = %v", header.Filename, err)
+			log.Errorf("Got an error scanning %s, err = %v", sample.Filename, err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
 			return
 		}
 
 		// Filter via namespace is provided
-		filteredNamespaces, hasNamespace := r.Form["namespace"]
-		matchRuleNames := make([]string, 0, len(m))
-		for _, rule := range m {
-			if !hasNamespace || stringArrayContains(filteredNamespaces, rule.Namespace) {
-				matchRuleNames = append(matchRuleNames, filepath.Join(rule.Namespace, rule.Rule))
-			}
-		}
+		filteredNamespaces, hasNamespace := form["namespace"]
+		verbose := r.URL.Query().Get("verbose") == "1"
 
-		jsonMatchRuleNames, _ := json.Marshal(matchRuleNames)
+		jsonMatches, _ := json.Marshal(formatMatches(matches, verbose, filteredNamespaces, hasNamespace))
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(fmt.Sprintf("{\"matchingRules\": %s}", jsonMatchRuleNames)))
+		w.Write([]byte(fmt.Sprintf("{\"matchingRules\": %s}", jsonMatches)))
 		return
 	}
 }
 
-func ListRules(rules *yara.Rules) func(w http.ResponseWriter, r *http.Request) {
+// Stats reports basic worker pool health: how many jobs have run, how
+// many detections they produced, and the current queue occupancy.
+func Stats(pool *WorkerPool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf(
+			"{\"jobsProcessed\": %d, \"detectionCount\": %d, \"queueDepth\": %d, \"queueCapacity\": %d}",
+			pool.JobsProcessed(), pool.DetectionCount(), pool.QueueDepth(), pool.QueueCapacity(),
+		)))
+	}
+}
+
+// AdminReload recompiles every configured rule source and, on
+// success, atomically swaps the new ruleset into rulesManager and
+// hot-reloads it into the worker pool.
+func AdminReload(rulesManager *RulesManager, pool *WorkerPool, metrics *Metrics) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		count, err := rulesManager.Reload(r.Context())
+		metrics.ObserveReload(count, err)
+		if err != nil {
+			log.Errorf("Got an error while reloading yara rules, err = %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("{\"error\": \"\", \"reason\":\"\"}"))
+			return
+		}
+		pool.SetRules(rulesManager.Current())
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("{\"rulesLoaded\": %d}", count)))
+	}
+}
+
+// refreshRulesPeriodically reloads the rule sources on a timer and
+// hot-swaps the pool's ruleset whenever a reload succeeds. Each reload
+// is bounded by reloadTimeout so that a hanging source (a stalled git
+// clone or HTTP GET) fails that tick instead of wedging this goroutine
+// for good: time.Ticker drops ticks rather than queuing them, so an
+// unbounded Reload would silently disable every future scheduled
+// reload for the life of the process.
+func refreshRulesPeriodically(rulesManager *RulesManager, pool *WorkerPool, metrics *Metrics, interval, reloadTimeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+		count, err := rulesManager.Reload(ctx)
+		cancel()
+		metrics.ObserveReload(count, err)
+		if err != nil {
+			log.Warnf("Got an error during periodic rule reload, err = %v", err)
+			continue
+		}
+		pool.SetRules(rulesManager.Current())
+	}
+}
+
+func ListRules(rulesManager *RulesManager) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		rules := rulesManager.Current()
 		ruleNames := make([]string, 0, len(rules.GetRules()))
 		for _, rule := range rules.GetRules() {
 			ruleNames = append(ruleNames, filepath.Join(rule.Namespace(), rule.Identifier()))
@@ -189,17 +321,15 @@ func stringArrayContains(array []string, elmt string) bool {
 	return false
 }
 
-func loadRulesFromDir(yaraRulesDir string) (*yara.Rules, error) {
-
-	c, err := yara.NewCompiler()
-	if c == nil || err != nil {
-		log.Errorf("Go an error while instanciating a new yara compiler, err = %v", err)
-		return nil, err
-	}
+// loadRulesFromDir walks yaraRulesDir and feeds every file it finds
+// to c, deriving the namespace of each file from its immediate parent
+// directory. It is also used as the dirRuleSource implementation, so
+// that a plain YARA_RULES_DIR keeps behaving exactly as before.
+func loadRulesFromDir(c *yara.Compiler, yaraRulesDir string) (int, error) {
 
 	rulesCount := 0
 
-	err = filepath.Walk(yaraRulesDir, func(path string, info fs.FileInfo, err error) error {
+	err := filepath.Walk(yaraRulesDir, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -225,14 +355,8 @@ func loadRulesFromDir(yaraRulesDir string) (*yara.Rules, error) {
 
 	if err != nil {
 		log.Debugf("Got an error while adding yara files from dir %s, err = %v", yaraRulesDir, err)
-		return nil, err
-	}
-
-	rules, err := c.GetRules()
-	if err != nil {
-		log.Debugf("Got an error while getting rules from yara compiler, err = %v", err)
-		return nil, err
+		return 0, err
 	}
 
-	return rules, nil
+	return rulesCount, nil
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/hillu/go-yara/v4"
+)
+
+// MatchDetail is the verbose representation of a single rule match,
+// carrying everything a caller needs to understand why a rule fired.
+type MatchDetail struct {
+	Rule      string                 `json:"rule"`
+	Namespace string                 `json:"namespace"`
+	Tags      []string               `json:"tags,omitempty"`
+	Metas     map[string]interface{} `json:"metas,omitempty"`
+	Strings   []MatchStringDetail    `json:"strings,omitempty"`
+}
+
+// MatchStringDetail is a single matched string/pattern and where it
+// was found in the scanned data.
+type MatchStringDetail struct {
+	Name   string `json:"name"`
+	Offset uint64 `json:"offset"`
+}
+
+// formatMatches renders matches either as the terse "namespace/rule"
+// string list the API has always returned, or, when verbose is true,
+// as structured MatchDetail objects.
+func formatMatches(matches yara.MatchRules, verbose bool, filteredNamespaces []string, hasNamespace bool) interface{} {
+	if verbose {
+		details := make([]MatchDetail, 0, len(matches))
+		for _, rule := range matches {
+			if hasNamespace && !stringArrayContains(filteredNamespaces, rule.Namespace) {
+				continue
+			}
+			details = append(details, MatchDetail{
+				Rule:      rule.Rule,
+				Namespace: rule.Namespace,
+				Tags:      rule.Tags,
+				Metas:     metasToMap(rule.Metas),
+				Strings:   matchStringDetails(rule.Strings),
+			})
+		}
+		return details
+	}
+
+	matchRuleNames := make([]string, 0, len(matches))
+	for _, rule := range matches {
+		if !hasNamespace || stringArrayContains(filteredNamespaces, rule.Namespace) {
+			matchRuleNames = append(matchRuleNames, filepath.Join(rule.Namespace, rule.Rule))
+		}
+	}
+	return matchRuleNames
+}
+
+func metasToMap(metas []yara.Meta) map[string]interface{} {
+	if len(metas) == 0 {
+		return nil
+	}
+	m := make(map[string]interface{}, len(metas))
+	for _, meta := range metas {
+		m[meta.Identifier] = meta.Value
+	}
+	return m
+}
+
+func matchStringDetails(strings []yara.MatchString) []MatchStringDetail {
+	if len(strings) == 0 {
+		return nil
+	}
+	details := make([]MatchStringDetail, 0, len(strings))
+	for _, s := range strings {
+		details = append(details, MatchStringDetail{Name: s.Name, Offset: s.Offset})
+	}
+	return details
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics groups the Prometheus collectors exposed by the service, so
+// that operators can graph scan throughput and detections per rule
+// over time.
+type Metrics struct {
+	ScansTotal   *prometheus.CounterVec
+	ScanDuration prometheus.Histogram
+	ScannedBytes prometheus.Histogram
+	MatchesTotal *prometheus.CounterVec
+	RulesLoaded  prometheus.Gauge
+	ReloadTotal  *prometheus.CounterVec
+}
+
+// Scan outcomes, used as the "outcome" label on ScansTotal.
+const (
+	outcomeOK         = "ok"
+	outcomeError      = "error"
+	outcomeBadRequest = "bad_request"
+)
+
+// NewMetrics creates and registers every collector on reg, labelling
+// them with the configured namespace/subsystem.
+func NewMetrics(reg prometheus.Registerer, namespace, subsystem string) *Metrics {
+	m := &Metrics{
+		ScansTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "scans_total",
+			Help:      "Total number of scans, by outcome.",
+		}, []string{"outcome"}),
+		ScanDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "scan_duration_seconds",
+			Help:      "Time spent scanning a single sample.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		ScannedBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "scanned_bytes",
+			Help:      "Size in bytes of scanned samples.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+		}),
+		MatchesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "matches_total",
+			Help:      "Total number of rule matches, by namespace and rule.",
+		}, []string{"namespace", "rule"}),
+		RulesLoaded: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rules_loaded",
+			Help:      "Number of rules currently compiled and loaded.",
+		}),
+		ReloadTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rule_reloads_total",
+			Help:      "Total number of rule reloads, by outcome (ok, error).",
+		}, []string{"outcome"}),
+	}
+
+	reg.MustRegister(m.ScansTotal, m.ScanDuration, m.ScannedBytes, m.MatchesTotal, m.RulesLoaded, m.ReloadTotal)
+	return m
+}
+
+// ObserveScan records the outcome, duration and size of a single
+// scan, plus one MatchesTotal increment per matched rule.
+func (m *Metrics) ObserveScan(outcome string, duration time.Duration, bytes int, matchesByRule map[ruleKey]int) {
+	m.ScansTotal.WithLabelValues(outcome).Inc()
+	m.ScanDuration.Observe(duration.Seconds())
+	m.ScannedBytes.Observe(float64(bytes))
+	for key, count := range matchesByRule {
+		m.MatchesTotal.WithLabelValues(key.namespace, key.rule).Add(float64(count))
+	}
+}
+
+// ObserveReload records a rule reload outcome and, on success, the
+// new total rule count.
+func (m *Metrics) ObserveReload(rulesCount int, err error) {
+	if err != nil {
+		m.ReloadTotal.WithLabelValues(outcomeError).Inc()
+		return
+	}
+	m.ReloadTotal.WithLabelValues(outcomeOK).Inc()
+	m.RulesLoaded.Set(float64(rulesCount))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hillu/go-yara/v4"
+)
+
+// RulesManager compiles a *yara.Rules from a list of RuleSource and
+// keeps the latest successful compilation available behind an
+// atomic.Pointer, so that Reload can be called at any time (on a
+// timer or from /admin/reload) without disturbing in-flight scans
+// against the previous ruleset.
+//
+// reloadMu serializes Reload: the git and HTTP sources fetch into the
+// same on-disk cache path for their namespace, removing and repopulating it
+// in place, so two reloads running at once could observe a half
+// deleted/half populated directory.
+type RulesManager struct {
+	sources  []RuleSource
+	cacheDir string
+	current  atomic.Pointer[yara.Rules]
+	reloadMu sync.Mutex
+}
+
+// NewRulesManager creates a manager for the given sources. Reload
+// must be called once before Current returns anything useful.
+func NewRulesManager(sources []RuleSource, cacheDir string) *RulesManager {
+	return &RulesManager{sources: sources, cacheDir: cacheDir}
+}
+
+// Current returns the most recently successfully compiled ruleset.
+func (rm *RulesManager) Current() *yara.Rules {
+	return rm.current.Load()
+}
+
+// Reload fetches every configured source into a fresh compiler and,
+// on success, atomically swaps in the recompiled ruleset. A failure
+// in any source aborts the whole reload and leaves Current unchanged.
+func (rm *RulesManager) Reload(ctx context.Context) (int, error) {
+	rm.reloadMu.Lock()
+	defer rm.reloadMu.Unlock()
+
+	c, err := yara.NewCompiler()
+	if c == nil || err != nil {
+		return 0, fmt.Errorf("instanciating yara compiler: %w", err)
+	}
+
+	if err := defineScanContextVariables(c); err != nil {
+		return 0, fmt.Errorf("defining scan context variables: %w", err)
+	}
+
+	for _, source := range rm.sources {
+		if _, err := source.Load(ctx, c, rm.cacheDir); err != nil {
+			return 0, fmt.Errorf("loading rule source %s: %w", source.Namespace(), err)
+		}
+	}
+
+	rules, err := c.GetRules()
+	if err != nil {
+		return 0, fmt.Errorf("getting compiled rules: %w", err)
+	}
+
+	rm.current.Store(rules)
+	return len(rules.GetRules()), nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hillu/go-yara/v4"
+)
+
+// RuleSource fetches (if needed) and compiles a set of YARA rule
+// files into a shared compiler. Namespace identifies the source; the
+// git and HTTP sources also use it to label every rule they
+// contribute, so matches can be traced back to where they came from,
+// while dirRuleSource labels each file by its parent directory.
+type RuleSource interface {
+	Namespace() string
+	Load(ctx context.Context, c *yara.Compiler, cacheDir string) (int, error)
+}
+
+// ParseRuleSource turns a package-URL-style string into a RuleSource.
+// Supported forms:
+//
+//	pkg:github/<org>/<repo>[#<subpath>]   shallow git clone
+//	pkg:https/<host>/<path>                HTTP(S) download, .tar.gz is extracted
+//	file:///<local/path>                    local directory, as YaraRulesDir
+func ParseRuleSource(raw string) (RuleSource, error) {
+	switch {
+	case strings.HasPrefix(raw, "pkg:github/"):
+		repoPath, subpath := splitFragment(strings.TrimPrefix(raw, "pkg:github/"))
+		parts := strings.SplitN(repoPath, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid rule source %q: expected pkg:github/<org>/<repo>", raw)
+		}
+		return &gitRuleSource{
+			url:       fmt.Sprintf("https://github.com/%s/%s", parts[0], parts[1]),
+			subpath:   subpath,
+			namespace: repoPath,
+		}, nil
+	case strings.HasPrefix(raw, "pkg:https/"):
+		host, _ := splitFragment(strings.TrimPrefix(raw, "pkg:https/"))
+		return &httpRuleSource{
+			url:       "https://" + host,
+			namespace: host,
+		}, nil
+	case strings.HasPrefix(raw, "file://"):
+		path := strings.TrimPrefix(raw, "file://")
+		return &dirRuleSource{dir: path}, nil
+	default:
+		return nil, fmt.Errorf("unsupported rule source %q", raw)
+	}
+}
+
+// splitFragment splits "a/b#c" into "a/b" and "c".
+func splitFragment(s string) (string, string) {
+	if i := strings.Index(s, "#"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// sanitizeCacheKey turns a namespace into a name that is safe to use
+// as a single path component.
+func sanitizeCacheKey(s string) string {
+	return strings.NewReplacer("/", "_", ":", "_", "#", "_").Replace(s)
+}
+
+// addRulesFromDir walks dir and feeds every *.yar/*.yara file it finds
+// to c under namespace, returning how many files were added.
+func addRulesFromDir(c *yara.Compiler, dir, namespace string) (int, error) {
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yar", ".yara":
+		default:
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := c.AddFile(f, namespace); err != nil {
+			return fmt.Errorf("adding %s: %w", path, err)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// gitRuleSource fetches rules from a shallow clone of a git
+// repository, e.g. pkg:github/Neo23x0/signature-base#yara.
+type gitRuleSource struct {
+	url       string
+	subpath   string
+	namespace string
+}
+
+func (g *gitRuleSource) Namespace() string { return g.namespace }
+
+func (g *gitRuleSource) Load(ctx context.Context, c *yara.Compiler, cacheDir string) (int, error) {
+	dest := filepath.Join(cacheDir, sanitizeCacheKey(g.namespace))
+	if err := os.RemoveAll(dest); err != nil {
+		return 0, err
+	}
+	cmd := exec.CommandContext(ctx, "git", "clone", "--depth", "1", g.url, dest)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return 0, fmt.Errorf("git clone %s: %w: %s", g.url, err, out)
+	}
+	return addRulesFromDir(c, filepath.Join(dest, g.subpath), g.namespace)
+}
+
+// httpRuleSource downloads rules from an HTTP(S) URL. Archives ending
+// in .tar.gz/.tgz are extracted; anything else is saved as a single
+// file and walked like any other source.
+type httpRuleSource struct {
+	url       string
+	namespace string
+}
+
+func (h *httpRuleSource) Namespace() string { return h.namespace }
+
+func (h *httpRuleSource) Load(ctx context.Context, c *yara.Compiler, cacheDir string) (int, error) {
+	dest := filepath.Join(cacheDir, sanitizeCacheKey(h.namespace))
+	if err := os.RemoveAll(dest); err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("fetching %s: %w", h.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("fetching %s: unexpected status %s", h.url, resp.Status)
+	}
+
+	switch {
+	case strings.HasSuffix(h.url, ".tar.gz"), strings.HasSuffix(h.url, ".tgz"):
+		if err := extractTarGz(resp.Body, dest); err != nil {
+			return 0, fmt.Errorf("extracting %s: %w", h.url, err)
+		}
+	default:
+		out, err := os.Create(filepath.Join(dest, filepath.Base(h.url)))
+		if err != nil {
+			return 0, err
+		}
+		_, err = io.Copy(out, resp.Body)
+		out.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return addRulesFromDir(c, dest, h.namespace)
+}
+
+// extractTarGz extracts a gzip-compressed tarball into dest.
+func extractTarGz(r io.Reader, dest string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		target := filepath.Join(dest, filepath.Clean(hdr.Name))
+		if !strings.HasPrefix(target, filepath.Clean(dest)+string(os.PathSeparator)) {
+			return fmt.Errorf("tar entry %q escapes destination directory", hdr.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		f, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// dirRuleSource reads rules straight from a local directory, the way
+// loadRulesFromDir always has: namespace is derived per-file from the
+// immediate parent directory name, and every file under it is handed
+// to the compiler regardless of extension.
+type dirRuleSource struct {
+	dir string
+}
+
+func (d *dirRuleSource) Namespace() string { return d.dir }
+
+func (d *dirRuleSource) Load(ctx context.Context, c *yara.Compiler, cacheDir string) (int, error) {
+	return loadRulesFromDir(c, d.dir)
+}
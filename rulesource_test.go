@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRuleSource(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		wantType  RuleSource
+		wantNS    string
+		wantError bool
+	}{
+		{
+			name:     "github with subpath",
+			raw:      "pkg:github/Neo23x0/signature-base#yara",
+			wantType: &gitRuleSource{},
+			wantNS:   "Neo23x0/signature-base",
+		},
+		{
+			name:     "github without subpath",
+			raw:      "pkg:github/Neo23x0/signature-base",
+			wantType: &gitRuleSource{},
+			wantNS:   "Neo23x0/signature-base",
+		},
+		{
+			name:      "github missing repo",
+			raw:       "pkg:github/Neo23x0",
+			wantError: true,
+		},
+		{
+			name:     "https",
+			raw:      "pkg:https/example.com/rules.tar.gz",
+			wantType: &httpRuleSource{},
+			wantNS:   "example.com/rules.tar.gz",
+		},
+		{
+			name:     "file",
+			raw:      "file:///opt/rules",
+			wantType: &dirRuleSource{},
+			wantNS:   "/opt/rules",
+		},
+		{
+			name:      "unsupported scheme",
+			raw:       "pkg:npm/left-pad",
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := ParseRuleSource(tt.raw)
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("ParseRuleSource(%q) = %v, want error", tt.raw, source)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseRuleSource(%q) returned unexpected error: %v", tt.raw, err)
+			}
+
+			switch tt.wantType.(type) {
+			case *gitRuleSource:
+				if _, ok := source.(*gitRuleSource); !ok {
+					t.Fatalf("ParseRuleSource(%q) = %T, want *gitRuleSource", tt.raw, source)
+				}
+			case *httpRuleSource:
+				if _, ok := source.(*httpRuleSource); !ok {
+					t.Fatalf("ParseRuleSource(%q) = %T, want *httpRuleSource", tt.raw, source)
+				}
+			case *dirRuleSource:
+				if _, ok := source.(*dirRuleSource); !ok {
+					t.Fatalf("ParseRuleSource(%q) = %T, want *dirRuleSource", tt.raw, source)
+				}
+			}
+
+			if got := source.Namespace(); got != tt.wantNS {
+				t.Errorf("ParseRuleSource(%q).Namespace() = %q, want %q", tt.raw, got, tt.wantNS)
+			}
+		})
+	}
+}
+
+// buildTarGz packs files (path -> content) into an in-memory gzip'd tar.
+func buildTarGz(t *testing.T, files map[string]string) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name: name,
+			Mode: 0o644,
+			Size: int64(len(content)),
+		}); err != nil {
+			t.Fatalf("writing tar header for %s: %v", name, err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("writing tar content for %s: %v", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar writer: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("closing gzip writer: %v", err)
+	}
+	return &buf
+}
+
+func TestExtractTarGz(t *testing.T) {
+	dest := t.TempDir()
+	archive := buildTarGz(t, map[string]string{
+		"rule.yar":      "rule dummy { condition: true }",
+		"sub/other.yar": "rule other { condition: false }",
+	})
+
+	if err := extractTarGz(archive, dest); err != nil {
+		t.Fatalf("extractTarGz returned unexpected error: %v", err)
+	}
+
+	for _, name := range []string{"rule.yar", filepath.Join("sub", "other.yar")} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Errorf("expected %s to be extracted: %v", name, err)
+		}
+	}
+}
+
+func TestExtractTarGzRejectsPathTraversal(t *testing.T) {
+	dest := t.TempDir()
+	archive := buildTarGz(t, map[string]string{
+		"../../etc/passwd": "root:x:0:0:root:/root:/bin/sh",
+	})
+
+	if err := extractTarGz(archive, dest); err == nil {
+		t.Fatal("extractTarGz should reject a tar entry that escapes dest, got nil error")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+
+	"github.com/hillu/go-yara/v4"
+)
+
+// ScanContext carries the per-request values exposed to rules as
+// YARA external variables. Many community rule sets key off these to
+// narrow matches to a given file type or location.
+type ScanContext struct {
+	Filename  string
+	Filepath  string
+	Extension string
+	FileType  string
+}
+
+// defineScanContextVariables registers, with empty defaults, every
+// external variable a ScanContext can set. This must be done once on
+// the compiler so that rules referencing them compile; the actual
+// values are set per-request on each worker's scanner, since
+// (*yara.Scanner).DefineVariable mutates scanner state and scanners
+// are not shared across goroutines.
+func defineScanContextVariables(c *yara.Compiler) error {
+	for _, v := range []string{"filename", "filepath", "extension", "filetype"} {
+		if err := c.DefineVariable(v, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanContextFromRequest builds a ScanContext for a fully buffered
+// download: filename comes from the URL, filepath from an optional
+// "path" form field, extension from the filename, and filetype is
+// sniffed from the content itself.
+func scanContextFromRequest(r *http.Request, filename string, data []byte) ScanContext {
+	return ScanContext{
+		Filename:  filename,
+		Filepath:  r.FormValue("path"),
+		Extension: filepath.Ext(filename),
+		FileType:  http.DetectContentType(data),
+	}
+}
+
+// scanContextFromUpload builds a ScanContext for a streamed multipart
+// upload: filetype is sniffed from the leading bytes captured by
+// spoolPart, whether or not the part was spilled to disk.
+func scanContextFromUpload(u *spooledUpload, path string) ScanContext {
+	return ScanContext{
+		Filename:  u.Filename,
+		Filepath:  path,
+		Extension: filepath.Ext(u.Filename),
+		FileType:  http.DetectContentType(u.Sniff),
+	}
+}
+
+// apply pushes the scan context's values onto scanner, which must be
+// exclusively owned by the calling goroutine.
+func (sc ScanContext) apply(scanner *yara.Scanner) error {
+	for name, value := range map[string]string{
+		"filename":  sc.Filename,
+		"filepath":  sc.Filepath,
+		"extension": sc.Extension,
+		"filetype":  sc.FileType,
+	} {
+		if err := scanner.DefineVariable(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
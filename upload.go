@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// ErrPayloadTooLarge marks an upload that exceeded the configured
+// hard limit (MAX_UPLOAD_BYTES), surfaced to callers as a 413.
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// spooledUpload is a single uploaded part that has been streamed to
+// memory (small) or spilled to a temp file (larger than
+// memoryThreshold), without ever buffering the whole multipart body
+// at once.
+type spooledUpload struct {
+	Filename string
+	Data     []byte // set when the part fit in memory
+	FilePath string // set when the part was spilled to disk
+	Size     int64
+	Sniff    []byte // leading bytes of the part, for content-type sniffing
+}
+
+// Close removes the backing temp file, if any.
+func (u *spooledUpload) Close() error {
+	if u.FilePath == "" {
+		return nil
+	}
+	return os.Remove(u.FilePath)
+}
+
+// spoolPart streams part into memory up to memoryThreshold bytes; any
+// remainder is spilled into a temp file under tmpDir rather than
+// growing an in-memory buffer without bound.
+func spoolPart(part *multipart.Part, memoryThreshold int64, tmpDir string) (*spooledUpload, error) {
+	data, err := io.ReadAll(io.LimitReader(part, memoryThreshold+1))
+	if err != nil {
+		return nil, asPayloadTooLarge(err)
+	}
+
+	sniffLen := len(data)
+	if sniffLen > 512 {
+		sniffLen = 512
+	}
+	sniff := append([]byte(nil), data[:sniffLen]...)
+
+	if int64(len(data)) <= memoryThreshold {
+		return &spooledUpload{Filename: part.FileName(), Data: data, Size: int64(len(data)), Sniff: sniff}, nil
+	}
+
+	f, err := os.CreateTemp(tmpDir, "yara-upload-*")
+	if err != nil {
+		return nil, err
+	}
+
+	written, err := f.Write(data)
+	if err == nil {
+		var n int64
+		n, err = io.Copy(f, part)
+		written += int(n)
+	}
+	closeErr := f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, asPayloadTooLarge(err)
+	}
+	if closeErr != nil {
+		os.Remove(f.Name())
+		return nil, closeErr
+	}
+
+	return &spooledUpload{Filename: part.FileName(), FilePath: f.Name(), Size: int64(written), Sniff: sniff}, nil
+}
+
+// asPayloadTooLarge normalizes an http.MaxBytesReader overflow into
+// ErrPayloadTooLarge so callers don't need to know about that type.
+func asPayloadTooLarge(err error) error {
+	var mbErr *http.MaxBytesError
+	if errors.As(err, &mbErr) {
+		return ErrPayloadTooLarge
+	}
+	return err
+}
+
+// collectMultipart walks a multipart/form-data request, spooling
+// every "sample" part (via spoolPart) and collecting every other
+// field into form, without ever buffering the whole request body.
+// form is seeded from the URL query string first, matching
+// ParseMultipartForm's behavior of unioning query and body values.
+func collectMultipart(r *http.Request, memoryThreshold int64, tmpDir string) (samples []*spooledUpload, form url.Values, err error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	form = url.Values{}
+	for key, values := range r.URL.Query() {
+		form[key] = append(form[key], values...)
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			closeSamples(samples)
+			return nil, nil, asPayloadTooLarge(err)
+		}
+
+		if part.FormName() == "sample" {
+			sample, err := spoolPart(part, memoryThreshold, tmpDir)
+			part.Close()
+			if err != nil {
+				closeSamples(samples)
+				return nil, nil, err
+			}
+			samples = append(samples, sample)
+			continue
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, 4096))
+		part.Close()
+		if err != nil {
+			closeSamples(samples)
+			return nil, nil, asPayloadTooLarge(err)
+		}
+		form.Add(part.FormName(), string(value))
+	}
+
+	return samples, form, nil
+}
+
+// closeSamples removes the temp files backing every spilled sample.
+func closeSamples(samples []*spooledUpload) {
+	for _, s := range samples {
+		s.Close()
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// newMultipartPart builds a single-field multipart body and returns
+// the *multipart.Part for it, so spoolPart can be tested in isolation
+// without going through a full HTTP request.
+func newMultipartPart(t *testing.T, fieldName, filename string, content []byte) *multipart.Part {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	fw, err := w.CreateFormFile(fieldName, filename)
+	if err != nil {
+		t.Fatalf("creating form file: %v", err)
+	}
+	if _, err := fw.Write(content); err != nil {
+		t.Fatalf("writing form file content: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing multipart writer: %v", err)
+	}
+
+	mr := multipart.NewReader(&buf, w.Boundary())
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("reading part back: %v", err)
+	}
+	return part
+}
+
+func TestSpoolPartThreshold(t *testing.T) {
+	tests := []struct {
+		name            string
+		size            int
+		memoryThreshold int64
+		wantSpilled     bool
+	}{
+		{name: "below threshold stays in memory", size: 10, memoryThreshold: 16, wantSpilled: false},
+		{name: "exactly at threshold stays in memory", size: 16, memoryThreshold: 16, wantSpilled: false},
+		{name: "one byte over threshold spills to disk", size: 17, memoryThreshold: 16, wantSpilled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := bytes.Repeat([]byte("a"), tt.size)
+			part := newMultipartPart(t, "sample", "sample.bin", content)
+
+			upload, err := spoolPart(part, tt.memoryThreshold, t.TempDir())
+			if err != nil {
+				t.Fatalf("spoolPart returned unexpected error: %v", err)
+			}
+			defer upload.Close()
+
+			if spilled := upload.FilePath != ""; spilled != tt.wantSpilled {
+				t.Errorf("spoolPart(%d bytes, threshold %d): spilled = %v, want %v", tt.size, tt.memoryThreshold, spilled, tt.wantSpilled)
+			}
+			if upload.Size != int64(tt.size) {
+				t.Errorf("upload.Size = %d, want %d", upload.Size, tt.size)
+			}
+
+			got := upload.Data
+			if upload.FilePath != "" {
+				got, err = os.ReadFile(upload.FilePath)
+				if err != nil {
+					t.Fatalf("reading spilled file: %v", err)
+				}
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("spooled content does not match input for size %d", tt.size)
+			}
+		})
+	}
+}
+
+func TestCollectMultipartSeedsFormFromQuery(t *testing.T) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if err := w.WriteField("path", "/tmp/sample.bin"); err != nil {
+		t.Fatalf("writing path field: %v", err)
+	}
+	fw, err := w.CreateFormFile("sample", "sample.bin")
+	if err != nil {
+		t.Fatalf("creating form file: %v", err)
+	}
+	if _, err := fw.Write([]byte("hello")); err != nil {
+		t.Fatalf("writing sample content: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing multipart writer: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/yara?namespace=foo&namespace=bar", &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	samples, form, err := collectMultipart(req, 1<<20, t.TempDir())
+	if err != nil {
+		t.Fatalf("collectMultipart returned unexpected error: %v", err)
+	}
+	defer closeSamples(samples)
+
+	if len(samples) != 1 {
+		t.Fatalf("got %d samples, want 1", len(samples))
+	}
+	if got := form.Get("path"); got != "/tmp/sample.bin" {
+		t.Errorf("form.Get(%q) = %q, want %q", "path", got, "/tmp/sample.bin")
+	}
+	if got := form["namespace"]; !urlValuesEqual(got, []string{"foo", "bar"}) {
+		t.Errorf("form[%q] = %v, want %v", "namespace", got, []string{"foo", "bar"})
+	}
+}
+
+func urlValuesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
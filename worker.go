@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/hillu/go-yara/v4"
+)
+
+// ruleKey identifies a rule for per-rule match counters.
+type ruleKey struct {
+	namespace string
+	rule      string
+}
+
+// ErrQueueFull is returned by Submit when the job queue is saturated
+// and the caller's enqueue timeout elapses before a worker frees up a
+// slot.
+var ErrQueueFull = errors.New("scan queue is full")
+
+// scanResult carries the outcome of a single scan job back to the
+// HTTP handler that submitted it.
+type scanResult struct {
+	matches yara.MatchRules
+	err     error
+}
+
+// Job describes a single scan to be performed by the worker pool.
+// Either Data holds the sample in memory, or FilePath names a spooled
+// temp file to scan from disk; Size is the byte count of a FilePath
+// job, used only for the scanned-bytes metric (a Data job is measured
+// by len(Data) and its Size is ignored). Result is invoked
+// exactly once, from whichever worker goroutine processes the job.
+type Job struct {
+	Data     []byte
+	FilePath string
+	Size     int64
+	Context  ScanContext
+	Result   func(yara.MatchRules, error)
+}
+
+// WorkerPool runs a fixed number of goroutines, each owning its own
+// *yara.Scanner, pulling jobs off a single buffered channel. This
+// avoids sharing one *yara.Scanner across goroutines, which go-yara
+// does not support.
+//
+// rules is held behind an atomic.Pointer so that SetRules can hot-swap
+// the compiled ruleset (e.g. after a /admin/reload) without stopping
+// the workers; each worker notices the change the next time it picks
+// up a job and recreates its scanner from the new rules.
+type WorkerPool struct {
+	jobChan        chan *Job
+	rules          atomic.Pointer[yara.Rules]
+	numWorkers     int
+	metrics        *Metrics
+	jobsProcessed  uint64
+	detectionCount uint64
+}
+
+// NewWorkerPool creates a worker pool that will scan against rules
+// once Start is called. queueSize bounds how many jobs may wait in
+// jobChan before Submit starts failing. metrics may be nil, in which
+// case no scan metrics are recorded.
+func NewWorkerPool(rules *yara.Rules, numWorkers, queueSize int, metrics *Metrics) *WorkerPool {
+	wp := &WorkerPool{
+		jobChan:    make(chan *Job, queueSize),
+		numWorkers: numWorkers,
+		metrics:    metrics,
+	}
+	wp.rules.Store(rules)
+	return wp
+}
+
+// SetRules swaps in a newly compiled ruleset. Workers pick it up for
+// the next job they process.
+func (wp *WorkerPool) SetRules(rules *yara.Rules) {
+	wp.rules.Store(rules)
+}
+
+// Start spins up the worker goroutines. It must be called once before
+// any call to Submit.
+func (wp *WorkerPool) Start() {
+	for i := 0; i < wp.numWorkers; i++ {
+		go wp.worker()
+	}
+}
+
+// Submit enqueues a job, blocking until a slot is free, the job is
+// accepted, or timeout elapses, in which case ErrQueueFull is
+// returned so the caller can answer with a 503.
+func (wp *WorkerPool) Submit(job *Job, timeout time.Duration) error {
+	select {
+	case wp.jobChan <- job:
+		return nil
+	case <-time.After(timeout):
+		return ErrQueueFull
+	}
+}
+
+// Scan submits data for scanning and blocks until a worker has
+// produced a result. timeout only bounds how long Submit waits for a
+// free slot in the queue; once the job is queued, Scan waits for a
+// worker to pick it up and finish it, however long that takes.
+func (wp *WorkerPool) Scan(data []byte, sc ScanContext, timeout time.Duration) (yara.MatchRules, error) {
+	resultChan := make(chan scanResult, 1)
+	job := &Job{
+		Data:    data,
+		Context: sc,
+		Result: func(m yara.MatchRules, err error) {
+			resultChan <- scanResult{matches: m, err: err}
+		},
+	}
+
+	if err := wp.Submit(job, timeout); err != nil {
+		return nil, err
+	}
+
+	res := <-resultChan
+	return res.matches, res.err
+}
+
+// ScanPath submits a sample already spooled to disk at path for
+// scanning, blocking until a worker has produced a result. size is
+// only used for the scanned-bytes metric.
+func (wp *WorkerPool) ScanPath(path string, size int64, sc ScanContext, timeout time.Duration) (yara.MatchRules, error) {
+	resultChan := make(chan scanResult, 1)
+	job := &Job{
+		FilePath: path,
+		Size:     size,
+		Context:  sc,
+		Result: func(m yara.MatchRules, err error) {
+			resultChan <- scanResult{matches: m, err: err}
+		},
+	}
+
+	if err := wp.Submit(job, timeout); err != nil {
+		return nil, err
+	}
+
+	res := <-resultChan
+	return res.matches, res.err
+}
+
+// QueueDepth returns the number of jobs currently waiting to be
+// picked up by a worker.
+func (wp *WorkerPool) QueueDepth() int {
+	return len(wp.jobChan)
+}
+
+// QueueCapacity returns the configured size of the job queue.
+func (wp *WorkerPool) QueueCapacity() int {
+	return cap(wp.jobChan)
+}
+
+// JobsProcessed returns the total number of jobs scanned so far.
+func (wp *WorkerPool) JobsProcessed() uint64 {
+	return atomic.LoadUint64(&wp.jobsProcessed)
+}
+
+// DetectionCount returns the total number of rule matches found so
+// far, across all jobs.
+func (wp *WorkerPool) DetectionCount() uint64 {
+	return atomic.LoadUint64(&wp.detectionCount)
+}
+
+// worker owns a single *yara.Scanner cloned from the pool's compiled
+// rules and scans jobs off jobChan until it is closed. It recreates
+// its scanner whenever it notices the pool's rules pointer changed.
+func (wp *WorkerPool) worker() {
+	var scanner *yara.Scanner
+	var scannerRules *yara.Rules
+
+	for job := range wp.jobChan {
+		rules := wp.rules.Load()
+		if scanner == nil || scannerRules != rules {
+			s, err := yara.NewScanner(rules)
+			if err != nil {
+				log.Errorf("Got an error creating a yara scanner for a worker, err = %v", err)
+				job.Result(nil, err)
+				continue
+			}
+			scanner, scannerRules = s, rules
+		}
+
+		if err := job.Context.apply(scanner); err != nil {
+			log.Errorf("Got an error setting scan context on scanner, err = %v", err)
+			job.Result(nil, err)
+			continue
+		}
+
+		start := time.Now()
+		var m yara.MatchRules
+		var err error
+		if job.FilePath != "" {
+			err = scanner.SetCallback(&m).ScanFile(job.FilePath)
+		} else {
+			err = scanner.SetCallback(&m).ScanMem(job.Data)
+		}
+		duration := time.Since(start)
+
+		atomic.AddUint64(&wp.jobsProcessed, 1)
+
+		outcome := outcomeOK
+		var matchesByRule map[ruleKey]int
+		if err != nil {
+			outcome = outcomeError
+		} else if len(m) > 0 {
+			atomic.AddUint64(&wp.detectionCount, uint64(len(m)))
+			matchesByRule = make(map[ruleKey]int, len(m))
+			for _, rule := range m {
+				matchesByRule[ruleKey{namespace: rule.Namespace, rule: rule.Rule}]++
+			}
+		}
+
+		size := job.Size
+		if job.FilePath == "" {
+			size = int64(len(job.Data))
+		}
+		if wp.metrics != nil {
+			wp.metrics.ObserveScan(outcome, duration, int(size), matchesByRule)
+		}
+
+		job.Result(m, err)
+	}
+}